@@ -0,0 +1,1479 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func prePrepareOf(t testing.TB, numOfTxns int) Message {
+	/*
+		pre-prepare msg of a batch of signed txns, the msg the committees send the most of
+	*/
+	t.Helper()
+	sender, receiver := newClient(), newClient()
+	txns := make([]Transaction, numOfTxns)
+	for i := range txns {
+		txns[i] = sender.newTransaction(receiver.Address, big.NewInt(int64(1000+i)))
+	}
+	identityobj := IDENTITY{IP: "127.0.0.1", PK: sender.key.PublicKey, CommitteeID: 1, PoW: PoWmsg{Hash: "00ab", SetOfRs: []string{"r1", "r2"}, Nonce: 7}, EpochRandomness: "e1", Port: 49160}
+	data := PrePrepareMsg{Message: txns, PrePrepareData: PrePrepareContents{Type: "pre-prepare", ViewID: 0, Seq: 1, Digest: txnHexdigest(txns)}, Sign: "c2lnbg==", Identity: identityobj}
+	return Message{Data: data, Type: "pre-prepare", Epoch: 2}
+}
+
+func withCodec(c Codec, f func()) {
+	saved := codec
+	codec = c
+	defer func() { codec = saved }()
+	f()
+}
+
+func decodePrePrepare(body []byte) (msgType, PrePrepareMsg, error) {
+	var envelope msgType
+	var data PrePrepareMsg
+	if err := codec.Unmarshal(body, &envelope); err != nil {
+		return envelope, data, err
+	}
+	err := codec.Unmarshal(envelope.Data, &data)
+	return envelope, data, err
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	msg := prePrepareOf(t, 4)
+	sent := msg.Data.(PrePrepareMsg)
+	for name, c := range map[string]Codec{"json": jsonCodec{}, "binary": newBinaryCodec()} {
+		withCodec(c, func() {
+			envelope, data, err := decodePrePrepare(marshalData(msg))
+			if err != nil {
+				t.Fatalf("%s : decode error %v", name, err)
+			}
+			if envelope.Type != msg.Type || envelope.Epoch != msg.Epoch {
+				t.Fatalf("%s : envelope %s/%d, sent %s/%d", name, envelope.Type, envelope.Epoch, msg.Type, msg.Epoch)
+			}
+			if txnHexdigest(data.Message) != sent.PrePrepareData.Digest || data.Identity.isEqual(&sent.Identity) == false {
+				t.Fatalf("%s : decoded msg differs from the sent one", name)
+			}
+			if err := verifyTxnSigns(data.Message); err != nil {
+				t.Fatalf("%s : signatures lost in the round trip : %v", name, err)
+			}
+		})
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	/*
+		size, encode and decode cost of a pre-prepare of batchSize and of 32 txns for each codec
+	*/
+	for _, numOfTxns := range []int{batchSize, 32} {
+		msg := prePrepareOf(b, numOfTxns)
+		for _, name := range []string{"json", "binary"} {
+			c := Codec(jsonCodec{})
+			if name == "binary" {
+				c = newBinaryCodec()
+			}
+			withCodec(c, func() {
+				body := marshalData(msg)
+				b.Run(name+"/encode/txns="+strconv.Itoa(numOfTxns), func(b *testing.B) {
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						marshalData(msg)
+					}
+					b.ReportMetric(float64(len(body)), "bytes/msg")
+				})
+				b.Run(name+"/decode/txns="+strconv.Itoa(numOfTxns), func(b *testing.B) {
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						if _, _, err := decodePrePrepare(body); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.ReportMetric(float64(len(body)), "bytes/msg")
+				})
+			})
+		}
+	}
+}
+
+func committeeOf(t testing.TB, size int) []*Elastico {
+	/*
+		members of a pbft instance with their keys and PoW, the first one is the primary of view 0
+	*/
+	t.Helper()
+	nodes := make([]*Elastico, size)
+	members := make([]IDENTITY, size)
+	for i := range nodes {
+		e := &Elastico{Port: 49152 + i}
+		e.reset()
+		e.initER()
+		for e.state != ElasticoStates["PoW Computed"] {
+			e.computePoW()
+		}
+		e.Identity = IDENTITY{IP: e.IP, PK: e.key.PublicKey, CommitteeID: 0, PoW: e.PoW, EpochRandomness: e.EpochRandomness, Port: e.Port}
+		nodes[i], members[i] = e, e.Identity
+	}
+	for _, e := range nodes {
+		e.pbftMembers = members
+		e.committeeMembers = members
+		e.state = ElasticoStates["PBFT_PREPARE_SENT"]
+	}
+	return nodes
+}
+
+func requestOf(numOfTxns int) []Transaction {
+	sender, receiver := newClient(), newClient()
+	txns := make([]Transaction, numOfTxns)
+	for i := range txns {
+		txns[i] = sender.newTransaction(receiver.Address, big.NewInt(int64(1+i)))
+	}
+	return txns
+}
+
+func TestPreparedCertOfViewChange(t *testing.T) {
+	nodes := committeeOf(t, 4)
+	primary, backup, verifier := nodes[0], nodes[1], nodes[3]
+	txns := requestOf(2)
+	backup.logPrePrepareMsg(primary.signPrePrepare("pre-prepare", 0, 1, txns, false))
+	for _, e := range nodes[1:3] {
+		backup.logPrepareMsg(e.signPrepare(1, 1, txnHexdigest(txns)).Data.(PrepareMsg))
+	}
+	if backup.isPrepared() == false {
+		t.Fatal("request not prepared with 2f prepares")
+	}
+	cert := backup.preparedCerts[1]
+	if err := verifier.verifyPreparedCert(cert, false); err != nil {
+		t.Fatalf("certificate of a prepared request rejected : %v", err)
+	}
+
+	tampered := cert
+	tampered.Txns = requestOf(2)
+	if verifier.verifyPreparedCert(tampered, false) == nil {
+		t.Fatal("certificate accepted for other txns")
+	}
+	tampered = cert
+	tampered.ViewID = 1
+	if verifier.verifyPreparedCert(tampered, false) == nil {
+		t.Fatal("certificate accepted for a view its primary did not propose in")
+	}
+	tampered = cert
+	tampered.Prepares = []PrepareMsg{cert.Prepares[0], cert.Prepares[0]}
+	if verifier.verifyPreparedCert(tampered, false) == nil {
+		t.Fatal("certificate accepted with the same prepare twice")
+	}
+	// a prepare signed by a member in the name of another one
+	forged := nodes[2].signPrepare(1, 1, txnHexdigest(txns)).Data.(PrepareMsg)
+	forged.Identity = nodes[1].Identity
+	tampered = cert
+	tampered.Prepares = []PrepareMsg{forged, verifier.signPrepare(1, 1, txnHexdigest(txns)).Data.(PrepareMsg)}
+	if verifier.verifyPreparedCert(tampered, false) == nil {
+		t.Fatal("certificate accepted with a forged prepare")
+	}
+	tampered.Prepares[0] = primary.signPrepare(1, 1, txnHexdigest(txns)).Data.(PrepareMsg)
+	if verifier.verifyPreparedCert(tampered, false) == nil {
+		t.Fatal("certificate accepted with a prepare of the primary")
+	}
+}
+
+func TestInstanceEndsAtTheLastRequestOfThePrimary(t *testing.T) {
+	e := committeeOf(t, 4)[1]
+	// the member has a txn the primary never got
+	e.requestTxns = requestOf(3)
+	e.committedData[0] = map[int][]Transaction{2: e.requestTxns[:1]}
+	if e.allRequestsCommitted() {
+		t.Fatal("instance ended before the primary declared its last request")
+	}
+	e.lastSeq = 2
+	if e.allRequestsCommitted() {
+		t.Fatal("instance ended with a request below the last one not committed")
+	}
+	e.committedData[0][1] = e.requestTxns[1:2]
+	if e.allRequestsCommitted() == false {
+		t.Fatal("instance not ended once every request up to the last one committed")
+	}
+	if requestDigest(e.requestTxns, true) == requestDigest(e.requestTxns, false) {
+		t.Fatal("last request has the digest of the same txns proposed earlier")
+	}
+}
+
+func TestQuorumPolicy(t *testing.T) {
+	for F := 0; F <= 3; F++ {
+		q := QuorumPolicy{F: F}
+		if q.Strong() != 2*F+1 || q.Weak() != F+1 || q.Prepares() != 2*F {
+			t.Fatalf("f=%d : strong %d weak %d prepares %d", F, q.Strong(), q.Weak(), q.Prepares())
+		}
+		if err := q.validate(3*F + 1); err != nil {
+			t.Fatalf("f=%d : committee of 3f+1 members rejected : %v", F, err)
+		}
+		if q.validate(3*F) == nil {
+			t.Fatalf("f=%d : committee of 3f members accepted", F)
+		}
+	}
+	if (QuorumPolicy{F: -1}).validate(4) == nil {
+		t.Fatal("negative f accepted")
+	}
+}
+
+func byzantineCommittee(t *testing.T) ([]*Elastico, *Elastico, []Transaction) {
+	/*
+		committee of 7 members tolerating f=2, the last member checks the certificates of a request of the primary
+	*/
+	t.Helper()
+	saved := quorum
+	quorum = QuorumPolicy{F: 2}
+	t.Cleanup(func() { quorum = saved })
+	nodes := committeeOf(t, 7)
+	e := nodes[6]
+	txns := requestOf(2)
+	e.logPrePrepareMsg(nodes[0].signPrePrepare("pre-prepare", 0, 1, txns, false))
+	return nodes, e, txns
+}
+
+func TestPreparedNeedsStrongQuorum(t *testing.T) {
+	nodes, e, txns := byzantineCommittee(t)
+	digest := txnHexdigest(txns)
+	outsider := committeeOf(t, 1)[0]
+	// f byzantine members forge a prepare of another member and prepare other txns, an outsider prepares too
+	for _, byzantine := range nodes[4:6] {
+		forged := byzantine.signPrepare(1, 1, digest).Data.(PrepareMsg)
+		forged.Identity = nodes[1].Identity
+		if e.processPrepareMsg(forged) == nil {
+			t.Fatal("forged prepare accepted")
+		}
+		if e.processPrepareMsg(byzantine.signPrepare(1, 1, txnHexdigest(requestOf(1))).Data.(PrepareMsg)) == nil {
+			t.Fatal("prepare of a request the primary did not propose accepted")
+		}
+	}
+	if err := e.processPrepareMsg(outsider.signPrepare(1, 1, digest).Data.(PrepareMsg)); err != nil {
+		t.Fatal(err)
+	}
+	// the pre-prepare of the primary and the prepares of the honest backups, one of them sent twice
+	signers := map[int]bool{nodes[0].Port: true}
+	for _, honest := range []*Elastico{nodes[1], nodes[1], nodes[2], nodes[3], e} {
+		if err := e.processPrepareMsg(honest.signPrepare(1, 1, digest).Data.(PrepareMsg)); err != nil {
+			t.Fatal(err)
+		}
+		signers[honest.Port] = true
+		if prepared := e.isPrepared(); prepared != (len(signers) >= quorum.Strong()) {
+			t.Fatalf("prepared %v with %d matching signers", prepared, len(signers))
+		}
+	}
+	if len(signers) != quorum.Strong() {
+		t.Fatalf("%d signers in the end", len(signers))
+	}
+}
+
+func TestCommittedNeedsStrongQuorum(t *testing.T) {
+	nodes, e, txns := byzantineCommittee(t)
+	digest := txnHexdigest(txns)
+	for _, backup := range []*Elastico{nodes[1], nodes[2], nodes[3], e} {
+		if err := e.processPrepareMsg(backup.signPrepare(1, 1, digest).Data.(PrepareMsg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e.isPrepared() == false {
+		t.Fatal("request not prepared")
+	}
+	outsider := committeeOf(t, 1)[0]
+	for _, byzantine := range nodes[4:6] {
+		forged := byzantine.signCommit(1, 1, digest).Data.(CommitMsg)
+		forged.Identity = nodes[1].Identity
+		if e.processCommitMsg(forged) == nil {
+			t.Fatal("forged commit accepted")
+		}
+		// a commit of other txns is logged but does not match the request
+		if err := e.processCommitMsg(byzantine.signCommit(1, 1, txnHexdigest(requestOf(1))).Data.(CommitMsg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.processCommitMsg(outsider.signCommit(1, 1, digest).Data.(CommitMsg)); err != nil {
+		t.Fatal(err)
+	}
+	signers := make(map[int]bool)
+	for _, honest := range []*Elastico{nodes[0], nodes[1], nodes[1], nodes[2], nodes[3], e} {
+		if err := e.processCommitMsg(honest.signCommit(1, 1, digest).Data.(CommitMsg)); err != nil {
+			t.Fatal(err)
+		}
+		signers[honest.Port] = true
+		if committed := e.isCommitted(); committed != (len(signers) >= quorum.Strong()) {
+			t.Fatalf("committed %v with %d matching signers", committed, len(signers))
+		}
+	}
+	if len(signers) != quorum.Strong() {
+		t.Fatalf("%d signers in the end", len(signers))
+	}
+}
+
+func TestRoundChangeProvesPreparedReports(t *testing.T) {
+	nodes := committeeOf(t, 4)
+	reports := make([]IntraConsistencyMsg, 0, len(nodes))
+	for i, e := range nodes[:3] {
+		commitments := []string{"commitment" + strconv.Itoa(i)}
+		reports = append(reports, IntraConsistencyMsg{Identity: e.Identity, Commitments: commitments, Sign: e.Sign(e.digestConsistencyReport(commitments))})
+	}
+	prepares := make([]ConsistencyMsg, 0, len(nodes))
+	for _, e := range nodes[:3] {
+		prepares = append(prepares, e.signConsistencyMsg("ConsistencyPrepare", 0, reports))
+	}
+	roundChangeOf := func(e *Elastico, preparedRound int, prepares []ConsistencyMsg) ConsistencyRoundChange {
+		data := ConsistencyRoundChange{NewRound: 1, PreparedRound: preparedRound, Reports: reports, Prepares: prepares}
+		data.Sign = e.Sign(e.digestRoundChange(data))
+		data.Identity = e.Identity
+		return data
+	}
+	verifier := nodes[3]
+	if err := verifier.verifyRoundChange(roundChangeOf(nodes[1], 0, prepares)); err != nil {
+		t.Fatalf("round change with the prepared certificate rejected : %v", err)
+	}
+	if verifier.verifyRoundChange(roundChangeOf(nodes[1], 0, prepares[:2])) == nil {
+		t.Fatal("round change accepted with 2f prepares")
+	}
+	if verifier.verifyRoundChange(roundChangeOf(nodes[1], 0, []ConsistencyMsg{prepares[0], prepares[0], prepares[1]})) == nil {
+		t.Fatal("round change accepted with the same prepare twice")
+	}
+	otherRound := []ConsistencyMsg{prepares[0], prepares[1], nodes[2].signConsistencyMsg("ConsistencyPrepare", 1, reports)}
+	if verifier.verifyRoundChange(roundChangeOf(nodes[1], 0, otherRound)) == nil {
+		t.Fatal("round change accepted with a prepare of another round")
+	}
+	// a member claims the reports were prepared in a later round than they were
+	if verifier.verifyRoundChange(roundChangeOf(nodes[1], 1, prepares)) == nil {
+		t.Fatal("round change accepted for a round the prepares are not of")
+	}
+	// the prepare of a member that did not send it, signed by another member
+	forged := nodes[1].signConsistencyMsg("ConsistencyPrepare", 0, reports)
+	forged.Identity = nodes[3].Identity
+	if verifier.verifyRoundChange(roundChangeOf(nodes[1], 0, []ConsistencyMsg{prepares[0], prepares[1], forged})) == nil {
+		t.Fatal("round change accepted with a forged prepare")
+	}
+}
+
+func consistencyReportsOf(nodes []*Elastico) []IntraConsistencyMsg {
+	reports := make([]IntraConsistencyMsg, 0, len(nodes))
+	for _, e := range nodes {
+		commitments := []string{"commitment" + strconv.Itoa(e.Port)}
+		reports = append(reports, IntraConsistencyMsg{Identity: e.Identity, Commitments: commitments, Sign: e.Sign(e.digestConsistencyReport(commitments))})
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Identity.PoW.Hash < reports[j].Identity.PoW.Hash })
+	return reports
+}
+
+func TestConsistencyProposal(t *testing.T) {
+	nodes := committeeOf(t, 4)
+	verifier := nodes[3]
+	proposalOf := func(e *Elastico, round int, reports []IntraConsistencyMsg, roundChanges []ConsistencyRoundChange) ConsistencyMsg {
+		data := e.signConsistencyMsg("ConsistencyPropose", round, reports)
+		data.Reports = reports
+		data.RoundChanges = roundChanges
+		return data
+	}
+	reports := consistencyReportsOf(nodes[:3])
+	if err := verifier.verifyConsistencyProposal(proposalOf(nodes[0], 0, reports, nil)); err != nil {
+		t.Fatalf("proposal of the proposer rejected : %v", err)
+	}
+	if verifier.verifyConsistencyProposal(proposalOf(nodes[1], 0, reports, nil)) == nil {
+		t.Fatal("proposal of a member that is not the proposer of the round accepted")
+	}
+	if verifier.verifyConsistencyProposal(proposalOf(nodes[0], 0, reports[:2], nil)) == nil {
+		t.Fatal("proposal with 2f reports accepted")
+	}
+	if verifier.verifyConsistencyProposal(proposalOf(nodes[0], 0, []IntraConsistencyMsg{reports[0], reports[0], reports[1]}, nil)) == nil {
+		t.Fatal("proposal with the same report twice accepted")
+	}
+
+	// the reports were prepared in round 0 by nodes[2], the proposer of round 1 has to propose them again
+	prepares := make([]ConsistencyMsg, 0, 3)
+	for _, e := range nodes[:3] {
+		prepares = append(prepares, e.signConsistencyMsg("ConsistencyPrepare", 0, reports))
+	}
+	roundChangeOf := func(e *Elastico, preparedRound int, reports []IntraConsistencyMsg, prepares []ConsistencyMsg) ConsistencyRoundChange {
+		data := ConsistencyRoundChange{NewRound: 1, PreparedRound: preparedRound, Reports: reports, Prepares: prepares}
+		data.Sign = e.Sign(e.digestRoundChange(data))
+		data.Identity = e.Identity
+		return data
+	}
+	roundChanges := []ConsistencyRoundChange{roundChangeOf(nodes[0], -1, nil, nil), roundChangeOf(nodes[2], 0, reports, prepares), roundChangeOf(nodes[3], -1, nil, nil)}
+	if err := verifier.verifyConsistencyProposal(proposalOf(nodes[1], 1, reports, roundChanges)); err != nil {
+		t.Fatalf("proposal of the prepared reports rejected : %v", err)
+	}
+	other := consistencyReportsOf(nodes[1:])
+	if verifier.verifyConsistencyProposal(proposalOf(nodes[1], 1, other, roundChanges)) == nil {
+		t.Fatal("proposal ignoring the reports prepared in a lower round accepted")
+	}
+	if verifier.verifyConsistencyProposal(proposalOf(nodes[1], 1, reports, roundChanges[:2])) == nil {
+		t.Fatal("proposal of round 1 with 2f round changes accepted")
+	}
+}
+
+func TestConsistencyLogsKeyTheSenderByPoW(t *testing.T) {
+	/*
+		the IP and port of a member are not signed, the same member under another port counts once
+	*/
+	nodes := committeeOf(t, 4)
+	e := nodes[3]
+	reports := consistencyReportsOf(nodes[:3])
+	report, vote := reports[0], nodes[0].signConsistencyMsg("ConsistencyPrepare", 0, reports)
+	roundChange := ConsistencyRoundChange{NewRound: 1, PreparedRound: -1, Identity: nodes[0].Identity}
+	for port := 50000; port < 50003; port++ {
+		report.Identity.Port, vote.Identity.Port, roundChange.Identity.Port = port, port, port
+		e.logConsistencyReport(report)
+		e.logConsistencyVote(vote)
+		e.logRoundChange(roundChange)
+	}
+	if len(e.consistency.reports) != 1 || len(e.consistency.votes["ConsistencyPrepare"][0]) != 1 || len(e.consistency.roundChanges[1]) != 1 {
+		t.Fatalf("one member logged as %d reports, %d prepares and %d round changes", len(e.consistency.reports), len(e.consistency.votes["ConsistencyPrepare"][0]), len(e.consistency.roundChanges[1]))
+	}
+}
+
+func TestLedgerKeepsOneBlockPerEpoch(t *testing.T) {
+	savedLedger, savedStates, savedEpochs, savedTxns := ledger, ledgerStates, ledgerEpochs, ledgerTxns
+	t.Cleanup(func() {
+		ledger, ledgerStates, ledgerEpochs, ledgerTxns = savedLedger, savedStates, savedEpochs, savedTxns
+	})
+	sender, receiver := newClient(), newClient()
+	ledger = make([]Block, 0)
+	ledgerStates = map[int]LedgerState{0: genesisState([]*Client{sender, receiver})}
+	ledgerEpochs = make(map[int]int)
+	ledgerTxns = make(map[int]map[string]int)
+
+	blockOf := func(amount int64) []FinalCommittedBlock {
+		finalBlock := FinalCommittedBlock{}
+		finalBlock.FinalBlockInit([]Transaction{sender.newTransaction(receiver.Address, big.NewInt(amount))}, nil)
+		return []FinalCommittedBlock{finalBlock}
+	}
+	appendBlock := func(epoch int, response []FinalCommittedBlock) {
+		e := &Elastico{Port: 49152 + epoch, response: response}
+		e.appendToLedger(epoch)
+	}
+	epoch0, epoch1 := blockOf(1), blockOf(2)
+	appendBlock(0, epoch0)
+	appendBlock(0, epoch0)
+	if len(ledger) != 1 {
+		t.Fatalf("%d blocks after two nodes appended the block of epoch 0", len(ledger))
+	}
+	appendBlock(1, epoch1)
+	states := []LedgerState{ledgerStates[1], ledgerStates[2]}
+	// a lagging node of the process appends the block of epoch 0 once the chain moved on, another one a conflicting block
+	appendBlock(0, epoch0)
+	appendBlock(1, blockOf(3))
+	if len(ledger) != 2 || ledger[1].header.prevBlockHash != ledger[0].hexdigest() {
+		t.Fatalf("ledger forked, %d blocks", len(ledger))
+	}
+	if ledgerStates[1] != states[0] || ledgerStates[2] != states[1] {
+		t.Fatal("state of a later epoch overwritten")
+	}
+}
+
+func rejoinStateOf(e *Elastico, member *Elastico, Rs []string) RejoinStateMsg {
+	/*
+		rejoin state of epoch 2 sent by e, signed as the member of the epoch of the recovering node
+	*/
+	commitments := make([]string, 0, len(Rs))
+	for _, R := range Rs {
+		commitments = append(commitments, e.hexdigest(R))
+	}
+	data := RejoinStateMsg{Epoch: 2, SetOfRs: Rs, RcommitmentSet: commitments, Identity: e.Identity, Member: member.Identity}
+	data.Sign = e.Sign(digestRejoinState(data))
+	data.MemberSign = member.Sign(digestRejoinState(data))
+	return data
+}
+
+func TestRejoinStateNeedsDistinctSigners(t *testing.T) {
+	nodes := committeeOf(t, 4)
+	recovering := nodes[3]
+	recovering.recovering = true
+	Rs := []string{"R0", "R1", "R2"}
+	otherSigner := rejoinStateOf(nodes[0], nodes[0], Rs)
+	otherSigner.Sign = nodes[1].Sign(digestRejoinState(otherSigner))
+	if recovering.receiveRejoinState(otherSigner, 1) == nil {
+		t.Fatal("rejoin state accepted with the sign of another member")
+	}
+	unsigned := rejoinStateOf(nodes[0], nodes[0], Rs)
+	unsigned.Sign = ""
+	if recovering.receiveRejoinState(unsigned, 1) == nil {
+		t.Fatal("unsigned rejoin state accepted")
+	}
+	uncommitted := rejoinStateOf(nodes[0], nodes[0], Rs)
+	uncommitted.SetOfRs = append(uncommitted.SetOfRs, "R3")
+	uncommitted.Sign = nodes[0].Sign(digestRejoinState(uncommitted))
+	uncommitted.MemberSign = uncommitted.Sign
+	if recovering.receiveRejoinState(uncommitted, 1) == nil {
+		t.Fatal("rejoin state accepted with a random string out of its commitment set")
+	}
+	if recovering.receiveRejoinState(rejoinStateOf(nodes[0], nodes[0], Rs[:2]), 1) == nil {
+		t.Fatal("rejoin state accepted with 2f random strings")
+	}
+	for i := 0; i < quorum.Weak(); i++ {
+		if err := recovering.receiveRejoinState(rejoinStateOf(nodes[0], nodes[0], Rs), 1); err != nil {
+			t.Fatalf("rejoin state of a member rejected : %v", err)
+		}
+	}
+	if recovering.rejoinEpoch != 0 {
+		t.Fatal("rejoined on the state of one member")
+	}
+	if err := recovering.receiveRejoinState(rejoinStateOf(nodes[1], nodes[1], Rs), 1); err != nil {
+		t.Fatalf("rejoin state of a member rejected : %v", err)
+	}
+	if recovering.rejoinEpoch != 2 {
+		t.Fatal("not rejoined on the state of f+1 members")
+	}
+}
+
+func TestRejoinStateOfSpoofedMembers(t *testing.T) {
+	/*
+		one node with f+1 PoWs claims the ports of f+1 members of the committee
+	*/
+	nodes := committeeOf(t, 4)
+	recovering := nodes[3]
+	recovering.recovering = true
+	Rs := []string{"R0", "R1", "R2"}
+	attackers := committeeOf(t, quorum.Weak())
+	for i, attacker := range attackers {
+		attacker.Identity.Port = nodes[i].Port
+		// as itself, as a member it has no key of, and as a member with its own key
+		signedAs := rejoinStateOf(attacker, attacker, Rs)
+		claimed := rejoinStateOf(attacker, attacker, Rs)
+		claimed.Member = nodes[i].Identity
+		withOwnKey := claimed
+		withOwnKey.Member.PK = attacker.Identity.PK
+		for _, state := range []RejoinStateMsg{signedAs, claimed, withOwnKey} {
+			if recovering.receiveRejoinState(state, 1) == nil {
+				t.Fatalf("rejoin state of attacker %d accepted", i)
+			}
+		}
+	}
+	if recovering.rejoinEpoch != 0 || len(recovering.rejoinStates) != 0 {
+		t.Fatalf("rejoined epoch %d with %d states", recovering.rejoinEpoch, len(recovering.rejoinStates))
+	}
+	// the node that lost its committee can not tell the members
+	recovering.pbftMembers = make([]IDENTITY, 0)
+	for i := 0; i < quorum.Weak(); i++ {
+		if recovering.receiveRejoinState(rejoinStateOf(nodes[i], nodes[i], Rs), 1) == nil {
+			t.Fatal("rejoin state accepted without the members of the epoch")
+		}
+	}
+	if recovering.rejoinEpoch != 0 {
+		t.Fatal("rejoined without the members of the epoch")
+	}
+}
+
+func TestRejoinStateOfTheCommitmentSetOfTheFinalBlock(t *testing.T) {
+	nodes := committeeOf(t, 4)
+	recovering := nodes[3]
+	recovering.recovering = true
+	Rs := []string{"R0", "R1", "R2"}
+	// the node got the final block of its epoch before the committee left it
+	recovering.newRcommitmentSet = map[string]bool{recovering.hexdigest("R0"): true, recovering.hexdigest("R1"): true, recovering.hexdigest("R2"): true, recovering.hexdigest("R3"): true}
+	if recovering.receiveRejoinState(rejoinStateOf(nodes[0], nodes[0], Rs), 1) == nil {
+		t.Fatal("rejoin state accepted with another commitment set than the final block")
+	}
+	Rs = append(Rs, "R3")
+	if err := recovering.receiveRejoinState(rejoinStateOf(nodes[0], nodes[0], Rs), 1); err != nil {
+		t.Fatalf("rejoin state of the commitment set of the final block rejected : %v", err)
+	}
+}
+
+func TestRecoveryRequestFromMembersOfItsEpoch(t *testing.T) {
+	nodes := committeeOf(t, 4)
+	member, outsider := nodes[0], committeeOf(t, 1)[0]
+	member.pastMembers = map[int][]IDENTITY{1: member.pbftMembers}
+	requestOf := func(e *Elastico, signer *Elastico) RecoveryRequestMsg {
+		data := RecoveryRequestMsg{Epoch: 1, Identity: e.Identity}
+		data.Sign = signer.Sign(signer.digestRecoveryRequest(data))
+		return data
+	}
+	if member.receiveRecoveryRequest(requestOf(nodes[1], nodes[2]), 2) == nil {
+		t.Fatal("recovery request accepted with the sign of another member")
+	}
+	if member.receiveRecoveryRequest(requestOf(outsider, outsider), 2) == nil {
+		t.Fatal("recovery request of a non member answered")
+	}
+	member.pastMembers[1] = member.pbftMembers[1:2]
+	if member.receiveRecoveryRequest(requestOf(nodes[2], nodes[2]), 3) == nil {
+		t.Fatal("recovery request of a non member of its epoch answered")
+	}
+}
+
+func TestFinalPrePrepareAppliesOnTheLedgerState(t *testing.T) {
+	nodes := committeeOf(t, 4)
+	primary, verifier := nodes[0], nodes[1]
+	sender, receiver := newClient(), newClient()
+	verifier.ledgerState = genesisState([]*Client{sender, receiver})
+	verifier.state = ElasticoStates["FinalPBFT_PREPARE_SENT"]
+	finalPrePrepareOf := func(txns []Transaction) PrePrepareMsg {
+		return primary.signPrePrepare("Finalpre-prepare", 0, 1, txns, false)
+	}
+	txn := sender.newTransaction(receiver.Address, big.NewInt(1))
+	if err := verifier.verifyFinalPrePrepare(finalPrePrepareOf([]Transaction{txn})); err != nil {
+		t.Fatalf("final pre-prepare of an executable block rejected : %v", err)
+	}
+	if verifier.verifyFinalPrePrepare(finalPrePrepareOf([]Transaction{txn, txn})) == nil {
+		t.Fatal("final pre-prepare accepted with a replayed txn")
+	}
+	overdraft := sender.newTransaction(receiver.Address, new(big.Int).Add(genesisBalance, big.NewInt(1)))
+	if verifier.verifyFinalPrePrepare(finalPrePrepareOf([]Transaction{overdraft})) == nil {
+		t.Fatal("final pre-prepare accepted with an overdraft")
+	}
+}
+
+func TestUTXOTxnsSpendTheOutputsOfTheLedger(t *testing.T) {
+	savedMode := ledgerMode
+	t.Cleanup(func() { ledgerMode = savedMode })
+	ledgerMode = "utxo"
+	clients := []*Client{newClient(), newClient(), newClient()}
+	state := genesisState(clients)
+	txns := createTxns(clients, state)
+	if len(txns) < 2 {
+		t.Fatalf("%d txns created on the genesis state", len(txns))
+	}
+	// half of the txns of the epoch are not in its block
+	state = applyBlock(state, txns[:len(txns)/2])
+	next := state.copy()
+	for _, txn := range createTxns(clients, state) {
+		if err := next.apply(txn); err != nil {
+			t.Fatalf("txn of the next epoch does not apply on the ledger : %v", err)
+		}
+	}
+	forged := txns[len(txns)/2]
+	forged.Receiver = clients[0].Address
+	if forged.Outputs[0].Owner == forged.Receiver {
+		forged.Receiver = clients[1].Address
+	}
+	if state.copy().apply(forged) == nil {
+		t.Fatal("txn applied with a receiver other than the owner of its first output")
+	}
+	forged = txns[len(txns)/2]
+	forged.Amount = new(big.Int).Add(forged.Amount, big.NewInt(1))
+	if state.copy().apply(forged) == nil {
+		t.Fatal("txn applied with an amount other than the one of its first output")
+	}
+}
+
+func TestReplayIsCheckedAgainstTheLedgerAtTheEpochStart(t *testing.T) {
+	savedLedger, savedStates, savedEpochs, savedTxns := ledger, ledgerStates, ledgerEpochs, ledgerTxns
+	t.Cleanup(func() {
+		ledger, ledgerStates, ledgerEpochs, ledgerTxns = savedLedger, savedStates, savedEpochs, savedTxns
+	})
+	sender, receiver := newClient(), newClient()
+	ledger = make([]Block, 0)
+	ledgerStates = map[int]LedgerState{0: genesisState([]*Client{sender, receiver})}
+	ledgerEpochs = make(map[int]int)
+	ledgerTxns = make(map[int]map[string]int)
+
+	txn := sender.newTransaction(receiver.Address, big.NewInt(1))
+	// a member of epoch 0 that lags behind the node of the process appending the block of the epoch
+	lagging := &Elastico{Port: 49152, ledgerTxns: txnIDsAt(0)}
+	finalBlock := FinalCommittedBlock{}
+	finalBlock.FinalBlockInit([]Transaction{txn}, nil)
+	(&Elastico{Port: 49153, response: []FinalCommittedBlock{finalBlock}}).appendToLedger(0)
+	if err := lagging.checkReplay(txn, make(map[string]bool)); err != nil {
+		t.Fatalf("txn of the epoch taken for a replay of its own block : %v", err)
+	}
+	if (&Elastico{Port: 49154, ledgerTxns: txnIDsAt(0)}).checkReplay(txn, make(map[string]bool)) != nil {
+		t.Fatal("ids of epoch 0 changed by its block")
+	}
+	if (&Elastico{Port: 49155, ledgerTxns: txnIDsAt(1)}).checkReplay(txn, make(map[string]bool)) == nil {
+		t.Fatal("replay of a txn of the ledger accepted in the next epoch")
+	}
+}
+
+func TestTxnTimestamp(t *testing.T) {
+	now := time.Now()
+	txn := Transaction{Timestamp: now.UnixNano()}
+	if err := checkTimestamp(txn, now); err != nil {
+		t.Fatalf("fresh txn dropped : %v", err)
+	}
+	txn.Timestamp = now.Add(-txnMaxAge - time.Second).UnixNano()
+	if checkTimestamp(txn, now) == nil {
+		t.Fatal("stale txn accepted")
+	}
+	txn.Timestamp = now.Add(txnMaxSkew + time.Second).UnixNano()
+	if checkTimestamp(txn, now) == nil {
+		t.Fatal("txn from the future accepted")
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	bodies := [][]byte{{}, []byte("x"), bytes.Repeat([]byte("elastico"), 1000)}
+	for _, body := range bodies {
+		if err := writeFrame(&buf, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, body := range bodies {
+		read, err := readFrame(&buf)
+		if err != nil || bytes.Equal(read, body) == false {
+			t.Fatalf("frame of %d bytes read back as %d bytes, err %v", len(body), len(read), err)
+		}
+	}
+	// a frame cut short by the peer
+	writeFrame(&buf, []byte("elastico"))
+	buf.Truncate(buf.Len() - 1)
+	if _, err := readFrame(&buf); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated frame read with err %v", err)
+	}
+}
+
+func TestFrameSizeLimit(t *testing.T) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxFrameSize+1)
+	if _, err := readFrame(bytes.NewReader(header[:])); err == nil {
+		t.Fatal("frame above maxFrameSize accepted")
+	}
+	binary.BigEndian.PutUint32(header[:], maxFrameSize)
+	// the size is accepted, only the missing body fails the read
+	if _, err := readFrame(bytes.NewReader(header[:])); err != io.EOF {
+		t.Fatalf("frame of maxFrameSize read with err %v", err)
+	}
+}
+
+func tcpNode(t *testing.T, port int) (*tcpTransport, IDENTITY) {
+	/*
+		tcp transport listening on the loopback, port 0 picks a free port
+	*/
+	t.Helper()
+	transport, err := newTCPTransport("127.0.0.1", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Close() })
+	return transport, IDENTITY{IP: "127.0.0.1", Port: transport.listener.Addr().(*net.TCPAddr).Port}
+}
+
+func receiveWithin(t *testing.T, bodies <-chan []byte, d time.Duration) []byte {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		return body
+	case <-time.After(d):
+		t.Fatal("no msg received")
+		return nil
+	}
+}
+
+func TestTCPLoopback(t *testing.T) {
+	sender, _ := tcpNode(t, 0)
+	receiver, receiverID := tcpNode(t, 0)
+	bodies, _ := receiver.Receive()
+	for i := 0; i < 3; i++ {
+		if err := sender.Send(receiverID, []byte("msg"+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if body := receiveWithin(t, bodies, 5*time.Second); string(body) != "msg"+strconv.Itoa(i) {
+			t.Fatalf("received %q as msg %d", body, i)
+		}
+	}
+}
+
+func TestTCPRetriesUntilThePeerListens(t *testing.T) {
+	sender, _ := tcpNode(t, 0)
+	// a free port nobody listens on yet
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	sender.Send(IDENTITY{IP: "127.0.0.1", Port: port}, []byte("late"))
+	// longer than the 6 dials of the writer used to last
+	time.Sleep(4 * time.Second)
+	receiver, _ := tcpNode(t, port)
+	bodies, _ := receiver.Receive()
+	if body := receiveWithin(t, bodies, 5*time.Second); string(body) != "late" {
+		t.Fatalf("received %q", body)
+	}
+}
+
+func TestTransportConformance(t *testing.T) {
+	/*
+		every carrier delivers Send, Multicast and Broadcast the same way
+	*/
+	carriers := map[string]func(t *testing.T) ([]Transport, []IDENTITY){
+		"chan": func(t *testing.T) ([]Transport, []IDENTITY) {
+			var transports []Transport
+			var ids []IDENTITY
+			for port := 49101; port <= 49103; port++ {
+				transports = append(transports, newChanTransport(port))
+				ids = append(ids, IDENTITY{IP: "127.0.0.1", Port: port})
+			}
+			return transports, ids
+		},
+		"tcp": func(t *testing.T) ([]Transport, []IDENTITY) {
+			var transports []Transport
+			var ids []IDENTITY
+			saved := tcpPeers
+			tcpPeers = nil
+			for i := 0; i < 3; i++ {
+				transport, id := tcpNode(t, 0)
+				transports = append(transports, transport)
+				ids = append(ids, id)
+				tcpPeers = append(tcpPeers, net.JoinHostPort(id.IP, strconv.Itoa(id.Port)))
+			}
+			t.Cleanup(func() { tcpPeers = saved })
+			return transports, ids
+		},
+	}
+	for name, build := range carriers {
+		t.Run(name, func(t *testing.T) {
+			transports, ids := build(t)
+			var inboxes []<-chan []byte
+			for _, transport := range transports {
+				if err := transport.Join(0); err != nil {
+					t.Fatal(err)
+				}
+				bodies, err := transport.Receive()
+				if err != nil {
+					t.Fatal(err)
+				}
+				inboxes = append(inboxes, bodies)
+			}
+			if err := transports[0].Send(ids[1], []byte("send")); err != nil {
+				t.Fatal(err)
+			}
+			if body := receiveWithin(t, inboxes[1], 5*time.Second); string(body) != "send" {
+				t.Fatalf("send received as %q", body)
+			}
+			if err := transports[0].Multicast(0, ids[1:], []byte("multicast")); err != nil {
+				t.Fatal(err)
+			}
+			for _, bodies := range inboxes[1:] {
+				if body := receiveWithin(t, bodies, 5*time.Second); string(body) != "multicast" {
+					t.Fatalf("multicast received as %q", body)
+				}
+			}
+			if err := transports[0].Broadcast([]byte("broadcast")); err != nil {
+				t.Fatal(err)
+			}
+			for _, bodies := range inboxes {
+				if body := receiveWithin(t, bodies, 5*time.Second); string(body) != "broadcast" {
+					t.Fatalf("broadcast received as %q", body)
+				}
+			}
+			// nothing else was delivered
+			for i, bodies := range inboxes {
+				select {
+				case body := <-bodies:
+					t.Fatalf("node %d received the extra msg %q", i, body)
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			for i, transport := range transports {
+				if err := transport.Close(); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case _, open := <-inboxes[i]:
+					if open {
+						t.Fatalf("node %d received a msg after Close", i)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("receive channel of node %d not closed by Close", i)
+				}
+			}
+		})
+	}
+}
+
+func recordedMsgs(t *testing.T) *[]string {
+	/*
+		register the "test" msg type, its handler records the payloads in their order of arrival
+	*/
+	received := make([]string, 0)
+	msgRegistry["test"] = msgHandler{
+		newData: func() interface{} { return new(string) },
+		handle: func(e *Elastico, data interface{}, epoch int) error {
+			received = append(received, *data.(*string))
+			return nil
+		},
+	}
+	t.Cleanup(func() { delete(msgRegistry, "test") })
+	return &received
+}
+
+func testMsg(t *testing.T, payload string, epoch int) msgType {
+	t.Helper()
+	data, err := codec.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgType{Data: data, Type: "test", Epoch: epoch}
+}
+
+func TestFutureMsgsBufferIsCapped(t *testing.T) {
+	recordedMsgs(t)
+	e := &Elastico{}
+	for i := 0; i < maxFutureMsgs+5; i++ {
+		e.consumeMsg(testMsg(t, strconv.Itoa(i), 1), 0)
+	}
+	if len(e.futureMsgs) != maxFutureMsgs || e.metrics.FutureBuffered != maxFutureMsgs || e.metrics.FutureDropped != 5 {
+		t.Fatalf("%d msgs buffered, metrics %+v", len(e.futureMsgs), e.metrics)
+	}
+	// the first msgs are kept, the last ones dropped
+	if payload := e.futureMsgs[maxFutureMsgs-1].Data; string(payload) != `"`+strconv.Itoa(maxFutureMsgs-1)+`"` {
+		t.Fatalf("last buffered msg %s", payload)
+	}
+}
+
+func TestFutureMsgsReplayInOrderOfArrival(t *testing.T) {
+	received := recordedMsgs(t)
+	e := &Elastico{}
+	for i, epoch := range []int{1, 2, 1, 2, 1} {
+		e.consumeMsg(testMsg(t, strconv.Itoa(i), epoch), 0)
+	}
+	// a msg of a past epoch is not buffered
+	e.consumeMsg(testMsg(t, "past", 0), 1)
+	if len(*received) != 0 || len(e.futureMsgs) != 5 || e.metrics.Discarded != 1 {
+		t.Fatalf("received %v, %d msgs buffered", *received, len(e.futureMsgs))
+	}
+	e.replayFutureMsgs(1)
+	if strings.Join(*received, ",") != "0,2,4" || e.metrics.FutureReplayed != 3 {
+		t.Fatalf("epoch 1 replayed %v", *received)
+	}
+	// the msgs of epoch 2 wait in their order
+	if len(e.futureMsgs) != 2 || string(e.futureMsgs[0].Data) != `"1"` || string(e.futureMsgs[1].Data) != `"3"` {
+		t.Fatalf("left in the buffer %v", e.futureMsgs)
+	}
+	// the node skipped epoch 2
+	e.replayFutureMsgs(3)
+	if len(e.futureMsgs) != 0 || len(*received) != 3 || e.metrics.Discarded != 3 {
+		t.Fatalf("received %v, %d msgs buffered after epoch 2 was skipped", *received, len(e.futureMsgs))
+	}
+}
+
+func TestMalformedMsgsAreRejectedAndCounted(t *testing.T) {
+	e := &Elastico{Port: 49201}
+	e.transport = newChanTransport(e.Port)
+	t.Cleanup(func() { e.transport.Close() })
+	e.startConsumer()
+	// the envelope itself can not be decoded, rejected by the consumer goroutine
+	e.transport.Send(IDENTITY{Port: e.Port}, []byte("not a msg"))
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&e.metrics.Rejected) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("undecodable envelope not rejected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, msg := range []msgType{
+		{Type: "no such type", Data: []byte("{}")},
+		{Type: "checkpoint", Data: []byte("{")},
+		{Type: "prepare", Data: []byte(`{"PrepareData": 1}`)},
+	} {
+		rejected := e.metrics.Rejected
+		e.consumeMsg(msg, 0)
+		if e.metrics.Rejected != rejected+1 {
+			t.Fatalf("msg type %q with payload %s not rejected", msg.Type, msg.Data)
+		}
+	}
+}
+
+func TestCheckpointBeforeThePBFTStarts(t *testing.T) {
+	nodes := committeeOf(t, 4)
+	receiver, sender := nodes[0], nodes[1]
+	receiver.pbftMembers = make([]IDENTITY, 0)
+	receiver.state = ElasticoStates["Receiving Committee Members"]
+	receiver.ledgerState = genesisState(nil)
+	contents := CheckpointContents{Type: "checkpoint", Seq: checkpointPeriod, StateDigest: "digest"}
+	data, err := codec.Marshal(CheckpointMsg{CheckpointData: contents, Sign: sender.Sign(sender.digestCheckpointMsg(contents)), Identity: sender.Identity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.consumeMsg(msgType{Data: data, Type: "checkpoint", Epoch: 0}, 0)
+	if receiver.metrics.Rejected != 0 || len(receiver.futureMsgs) != 1 {
+		t.Fatalf("early checkpoint rejected %d times, %d msgs buffered", receiver.metrics.Rejected, len(receiver.futureMsgs))
+	}
+	// the node starts the instance and replays the buffer as execute does
+	if err := receiver.startPBFT(false); err != nil {
+		t.Fatal(err)
+	}
+	receiver.replayFutureMsgs(0)
+	if receiver.metrics.Rejected != 0 || len(receiver.futureMsgs) != 0 {
+		t.Fatalf("replayed checkpoint rejected %d times, %d msgs buffered", receiver.metrics.Rejected, len(receiver.futureMsgs))
+	}
+	if _, ok := receiver.checkpoints.msgs[checkpointPeriod][sender.Identity.IP+":"+strconv.Itoa(sender.Port)]; ok == false {
+		t.Fatal("replayed checkpoint not logged")
+	}
+}
+
+func TestFinalBlockNeedsStrongQuorum(t *testing.T) {
+	/*
+		an equivocating final member signs two blocks, each with one correct member : neither block
+		is taken until 2f+1 members signed it
+	*/
+	nodes := committeeOf(t, 5)
+	final, receiver := nodes[:4], nodes[4]
+	receiver.state = ElasticoStates["Intra Consensus Result Sent to Final"]
+	blockA, blockB := requestOf(2), requestOf(3)
+	commitments := []string{"commitment"}
+	finalBlock := func(signer *Elastico, block []Transaction) {
+		t.Helper()
+		msg := FinalBlockMsg{CommitSet: commitments, Signature: signer.Sign(signer.digestCommitments(commitments)), Identity: signer.Identity, FinalBlock: block, FinalBlockSign: signer.signTxnList(block)}
+		if err := receiver.receiveFinalTxnBlock(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finalBlock(final[0], blockA)
+	finalBlock(final[0], blockB)
+	finalBlock(final[1], blockA)
+	finalBlock(final[2], blockB)
+	if receiver.state == ElasticoStates["FinalBlockReceived"] {
+		t.Fatalf("final block taken with %d signs", quorum.Weak())
+	}
+	receiver.checkCountForFinalData()
+	if len(receiver.response) != 0 {
+		t.Fatalf("%d final blocks in the response with %d signs", len(receiver.response), quorum.Weak())
+	}
+	finalBlock(final[3], blockA)
+	if receiver.state != ElasticoStates["FinalBlockReceived"] {
+		t.Fatal("final block not taken with 2f+1 signs")
+	}
+	receiver.checkCountForFinalData()
+	if len(receiver.response) != 1 || txnHexdigest(receiver.response[0].txnList) != txnHexdigest(blockA) {
+		t.Fatalf("response %v", receiver.response)
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	outsider := requestOf(1)[0]
+	for _, size := range []int{1, 2, 3, 4, 5, 7, 8} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			txns := requestOf(size)
+			block := Block{}
+			block.BlockInit(txns, "", 0, "")
+			root := block.RootHash()
+			for i, txn := range txns {
+				proof, err := block.ProveTransaction(txn)
+				if err != nil || proof.Index != i {
+					t.Fatalf("proof of txn %d : %+v, %v", i, proof, err)
+				}
+				if VerifyMerkleProof(txn, proof, root) == false {
+					t.Fatalf("proof of txn %d rejected", i)
+				}
+				// the txn is not at another index
+				for _, index := range []int{i + 1, i + 2, -1, i + 1<<len(proof.Siblings)} {
+					if VerifyMerkleProof(txn, MerkleProof{Index: index, Siblings: proof.Siblings}, root) {
+						t.Fatalf("proof of txn %d accepted at index %d", i, index)
+					}
+				}
+				// another txn can not use the proof
+				other := txns[(i+1)%size]
+				if size > 1 && VerifyMerkleProof(other, proof, root) {
+					t.Fatalf("proof of txn %d accepted for another txn", i)
+				}
+				for level := range proof.Siblings {
+					if proof.Siblings[level] == "" {
+						continue
+					}
+					tampered := MerkleProof{Index: i, Siblings: append([]string{}, proof.Siblings...)}
+					tampered.Siblings[level] = merkleLeaf(outsider)
+					if VerifyMerkleProof(txn, tampered, root) {
+						t.Fatalf("proof of txn %d accepted with the sibling of level %d tampered", i, level)
+					}
+					// the sibling put on the other side of the path
+					swapped := MerkleProof{Index: i ^ (1 << level), Siblings: proof.Siblings}
+					if VerifyMerkleProof(txn, swapped, root) {
+						t.Fatalf("proof of txn %d accepted with the sides of level %d swapped", i, level)
+					}
+				}
+			}
+			if _, err := block.ProveTransaction(outsider); err == nil {
+				t.Fatal("proof of a txn not in the block")
+			}
+		})
+	}
+}
+
+func TestMerkleProofOfAnEmptyBlock(t *testing.T) {
+	block := Block{}
+	block.BlockInit(nil, "", 0, "")
+	if block.RootHash() != fmt.Sprintf("%x", sha256.Sum256(nil)) {
+		t.Fatalf("root of an empty block %s", block.RootHash())
+	}
+	if _, err := block.data.merkleProof(0); err == nil {
+		t.Fatal("proof of a txn of an empty block")
+	}
+	if VerifyMerkleProof(requestOf(1)[0], MerkleProof{}, block.RootHash()) {
+		t.Fatal("txn proved in an empty block")
+	}
+}
+
+func TestMerkleInnerNodeIsNotALeaf(t *testing.T) {
+	/*
+		the leaves and the inner nodes are hashed with the prefixes 0 and 1
+	*/
+	txns := requestOf(4)
+	block := Block{}
+	block.BlockInit(txns, "", 0, "")
+	left, right := block.data.merkleTree[0][0], block.data.merkleTree[0][1]
+	asLeaf := sha256.Sum256(append([]byte{0}, left+right...))
+	if fmt.Sprintf("%x", asLeaf) == merkleParent(left, right) {
+		t.Fatal("inner node hashed as a leaf of the same bytes")
+	}
+	// the proof of txn 0 without its first level proves the inner node, no txn hashes to it
+	proof, _ := block.ProveTransaction(txns[0])
+	short := MerkleProof{Index: 0, Siblings: proof.Siblings[1:]}
+	for _, txn := range txns {
+		if VerifyMerkleProof(txn, short, block.RootHash()) {
+			t.Fatal("inner node proved as a txn")
+		}
+	}
+}
+
+func chainOf(t *testing.T, txns ...[]Transaction) []Block {
+	/*
+		blocks linked by the hash of the previous block, each signed by one final member
+	*/
+	chain := make([]Block, 0, len(txns))
+	for i, blockTxns := range txns {
+		prevBlockHash := ""
+		if i > 0 {
+			prevBlockHash = chain[i-1].hexdigest()
+		}
+		block := Block{}
+		block.BlockInit(blockTxns, prevBlockHash, i, "state"+strconv.Itoa(i))
+		block.addSignAndIdentities([]IdentityAndSign{{sign: "sign" + strconv.Itoa(i), identityobj: IDENTITY{IP: "127.0.0.1", Port: 49152 + i}}})
+		chain = append(chain, block)
+	}
+	return chain
+}
+
+func TestFileStoreLedgerRoundTrip(t *testing.T) {
+	fs, err := newFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain, err := fs.LoadLedger(3); err != nil || len(chain) != 0 {
+		t.Fatalf("%d blocks in a new store, err %v", len(chain), err)
+	}
+	chain := chainOf(t, requestOf(2), nil, requestOf(1))
+	for epoch, block := range chain {
+		if err := fs.AppendBlock(epoch, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the block of epoch 2 stored again with one more signature
+	chain[2].addSignAndIdentities([]IdentityAndSign{{sign: "late", identityobj: IDENTITY{IP: "127.0.0.1", Port: 1}}})
+	if err := fs.AppendBlock(2, chain[2]); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := fs.LoadLedger(3)
+	if err != nil || len(loaded) != 3 {
+		t.Fatalf("%d blocks loaded, err %v", len(loaded), err)
+	}
+	for i := range chain {
+		if loaded[i].hexdigest() != chain[i].hexdigest() || txnHexdigest(loaded[i].data.transactions) != txnHexdigest(chain[i].data.transactions) {
+			t.Fatalf("block %d differs once loaded", i)
+		}
+		if len(loaded[i].listSignaturesAndIdentityobjs) != len(chain[i].listSignaturesAndIdentityobjs) {
+			t.Fatalf("block %d loaded with %d signatures", i, len(loaded[i].listSignaturesAndIdentityobjs))
+		}
+	}
+	// only the epochs before the one to resume from
+	if loaded, err := fs.LoadLedger(2); err != nil || len(loaded) != 2 {
+		t.Fatalf("%d blocks loaded before epoch 2, err %v", len(loaded), err)
+	}
+}
+
+func TestFileStoreCutsATornLastLine(t *testing.T) {
+	fs, err := newFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := chainOf(t, requestOf(1), requestOf(1))
+	fs.AppendBlock(0, chain[0])
+	path := filepath.Join(fs.dir, "ledger.jsonl")
+	complete, _ := os.ReadFile(path)
+	// the process stopped in the middle of the write of the block of epoch 1
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write([]byte(`{"Epoch":1,"PrevBlockHash":"`))
+	file.Close()
+	if loaded, err := fs.LoadLedger(2); err != nil || len(loaded) != 1 {
+		t.Fatalf("%d blocks loaded with a torn last line, err %v", len(loaded), err)
+	}
+	if data, _ := os.ReadFile(path); bytes.Equal(data, complete) == false {
+		t.Fatalf("ledger file of %d bytes after the torn line was cut, %d before it was written", len(data), len(complete))
+	}
+	// the block written again on resume follows the complete records
+	fs.AppendBlock(1, chain[1])
+	if loaded, err := fs.LoadLedger(2); err != nil || len(loaded) != 2 {
+		t.Fatalf("%d blocks loaded after the torn line, err %v", len(loaded), err)
+	}
+}
+
+func TestFileStoreRejectsABrokenChain(t *testing.T) {
+	chain := chainOf(t, requestOf(1), requestOf(2))
+	broken := map[string]func(record *storedBlock){
+		"prev block hash": func(record *storedBlock) { record.PrevBlockHash = chain[1].hexdigest() },
+		"ancestors":       func(record *storedBlock) { record.NumAncestorBlocks = 0 },
+		"root hash":       func(record *storedBlock) { record.RootHash = chain[0].RootHash() },
+		"txns":            func(record *storedBlock) { record.Transactions = record.Transactions[:1] },
+	}
+	for name, breakRecord := range broken {
+		t.Run(name, func(t *testing.T) {
+			fs, err := newFileStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs.AppendBlock(0, chain[0])
+			fs.AppendBlock(1, chain[1])
+			data, _ := os.ReadFile(filepath.Join(fs.dir, "ledger.jsonl"))
+			lines := bytes.SplitAfter(data, []byte("\n"))
+			var record storedBlock
+			if err := json.Unmarshal(lines[1], &record); err != nil {
+				t.Fatal(err)
+			}
+			breakRecord(&record)
+			line, _ := json.Marshal(record)
+			os.WriteFile(filepath.Join(fs.dir, "ledger.jsonl"), append(append(lines[0], line...), '\n'), 0644)
+			if _, err := fs.LoadLedger(2); err == nil {
+				t.Fatal("ledger loaded with a broken block")
+			}
+		})
+	}
+}
+
+func TestFileStoreNodeRoundTrip(t *testing.T) {
+	fs, err := newFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := fs.LoadNode(3, 1); ok || err != nil {
+		t.Fatalf("state of a node never saved : %v %v", ok, err)
+	}
+	for epoch := 1; epoch <= 3; epoch++ {
+		state := NodeState{Epoch: epoch, Key: []byte("key"), SetOfRs: []string{"R" + strconv.Itoa(epoch)}, RcommitmentSet: []string{"H(R)"}}
+		if err := fs.SaveNode(3, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, ok, err := fs.LoadNode(3, 3)
+	if ok == false || err != nil || state.Epoch != 3 || string(state.Key) != "key" || strings.Join(state.SetOfRs, ",") != "R3" || strings.Join(state.RcommitmentSet, ",") != "H(R)" {
+		t.Fatalf("loaded %+v, %v %v", state, ok, err)
+	}
+	// the state of the epoch before is kept for the nodes one epoch behind, the older ones are removed
+	if _, ok, _ := fs.LoadNode(3, 2); ok == false {
+		t.Fatal("state of the epoch before removed")
+	}
+	if _, ok, _ := fs.LoadNode(3, 1); ok {
+		t.Fatal("state of two epochs before kept")
+	}
+	if fs.LastEpoch(3) != 3 || fs.LastEpoch(4) != 0 {
+		t.Fatalf("last epochs %d and %d", fs.LastEpoch(3), fs.LastEpoch(4))
+	}
+}
+
+func TestResumeAtTheEpochOfTheSlowestNode(t *testing.T) {
+	savedStore, savedN, savedLedger, savedStates, savedTxns := store, n, ledger, ledgerStates, ledgerTxns
+	t.Cleanup(func() {
+		store, n, ledger, ledgerStates, ledgerTxns = savedStore, savedN, savedLedger, savedStates, savedTxns
+	})
+	fs, err := newFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, n, ledgerStates, ledgerTxns = fs, 2, make(map[int]LedgerState), make(map[int]map[string]int)
+	clients := []*Client{newClient(), newClient()}
+	genesis := genesisState(clients)
+	// epoch 0 moved no funds, epoch 1 was finished by node 0 only
+	block := Block{}
+	block.BlockInit(nil, "", 0, genesis.rootHash())
+	fs.AppendBlock(0, block)
+	fs.SaveNode(0, NodeState{Epoch: 2})
+	fs.SaveNode(1, NodeState{Epoch: 1})
+	if startEpoch := resume(clients); startEpoch != 1 {
+		t.Fatalf("resumed at epoch %d", startEpoch)
+	}
+	if len(ledger) != 1 || ledger[0].hexdigest() != block.hexdigest() {
+		t.Fatalf("%d blocks in the ledger on resume", len(ledger))
+	}
+	if state, ok := ledgerStates[1]; ok == false || state.rootHash() != genesis.rootHash() {
+		t.Fatal("state of the epoch to resume from not built from the ledger")
+	}
+}
+
+func TestTxnSignCoversItsFields(t *testing.T) {
+	sender, receiver, other := newClient(), newClient(), newClient()
+	signed := sender.newTransaction(receiver.Address, big.NewInt(10))
+	if err := signed.verifySign(); err != nil {
+		t.Fatalf("signed txn rejected : %v", err)
+	}
+	tampered := map[string]func(txn *Transaction){
+		"amount":    func(txn *Transaction) { txn.Amount = big.NewInt(11) },
+		"receiver":  func(txn *Transaction) { txn.Receiver = other.Address },
+		"nonce":     func(txn *Transaction) { txn.Nonce++ },
+		"id":        func(txn *Transaction) { txn.ID = "id" },
+		"timestamp": func(txn *Transaction) { txn.Timestamp++ },
+		"sender":    func(txn *Transaction) { txn.Sender = other.Address },
+		// the key of another client, which does not own the sender address
+		"sender key": func(txn *Transaction) { txn.SenderPK = other.key.PublicKey },
+		// the address and the key of another client, the sign is not of its key
+		"sender and key": func(txn *Transaction) { txn.Sender, txn.SenderPK = other.Address, other.key.PublicKey },
+		"no key":         func(txn *Transaction) { txn.SenderPK = rsa.PublicKey{} },
+		"sign":           func(txn *Transaction) { txn.Sign = "not base64" },
+		"resigned":       func(txn *Transaction) { other.sign(txn) },
+	}
+	for name, tamper := range tampered {
+		txn := signed
+		txn.Amount = new(big.Int).Set(signed.Amount)
+		tamper(&txn)
+		if txn.verifySign() == nil {
+			t.Fatalf("txn with a tampered %s accepted", name)
+		}
+		if verifyTxnSigns([]Transaction{signed, txn}) == nil {
+			t.Fatalf("txn list with a tampered %s accepted", name)
+		}
+	}
+	if err := verifyTxnSigns([]Transaction{signed}); err != nil {
+		t.Fatalf("signed txn list rejected : %v", err)
+	}
+	if validTxns([]Transaction{{Sender: sender.Address}}) == nil {
+		t.Fatal("txn without amount accepted")
+	}
+}
+
+func TestTxnCommitteeIsDeterministic(t *testing.T) {
+	savedMode := ledgerMode
+	t.Cleanup(func() { ledgerMode = savedMode })
+	numOfCommittees := int64(4)
+	sender, receiver := newClient(), newClient()
+
+	ledgerMode = "account"
+	first := txnCommittee(sender.newTransaction(receiver.Address, big.NewInt(1)), numOfCommittees)
+	for i := 0; i < 8; i++ {
+		// every txn of the sender, whatever its receiver, amount and nonce
+		txn := sender.newTransaction([]string{receiver.Address, sender.Address}[i%2], big.NewInt(int64(2+i)))
+		if committee := txnCommittee(txn, numOfCommittees); committee != first || committee < 0 || committee >= numOfCommittees {
+			t.Fatalf("txn %d of the sender in committee %d, the first one in %d", i, committee, first)
+		}
+	}
+
+	ledgerMode = "utxo"
+	inputs := []TxnInput{{TxnID: "c", Index: 0}, {TxnID: "a", Index: 1}, {TxnID: "a", Index: 0}, {TxnID: "b", Index: 3}}
+	least := txnCommittee(Transaction{Inputs: []TxnInput{{TxnID: "a", Index: 0}}}, numOfCommittees)
+	for i := 0; i < len(inputs); i++ {
+		// the same inputs in another order
+		shuffled := append(append([]TxnInput{}, inputs[i:]...), inputs[:i]...)
+		if committee := txnCommittee(Transaction{Inputs: shuffled, Sender: sender.Address}, numOfCommittees); committee != least {
+			t.Fatalf("txn of inputs %v in committee %d, its least input in %d", shuffled, committee, least)
+		}
+	}
+	// the sender does not matter, only the least input
+	if committee := txnCommittee(Transaction{Inputs: inputs, Sender: receiver.Address}, numOfCommittees); committee != least {
+		t.Fatalf("txn of another sender in committee %d, its least input in %d", committee, least)
+	}
+}
+
+func TestConflictingSpendsHaveOneWinner(t *testing.T) {
+	/*
+		the committees of two txns spending the same output both commit them, every final member keeps
+		the one of the lower committee id
+	*/
+	savedMode, savedS := ledgerMode, s
+	t.Cleanup(func() { ledgerMode, s = savedMode, savedS })
+	ledgerMode, s = "utxo", 1
+	sender, receiver, other := newClient(), newClient(), newClient()
+	genesis := genesisState([]*Client{sender, receiver, other})
+	sender.unspent = genesis.(*UTXOSet).unspentOf(sender.Address)
+	toReceiver, ok := sender.newUTXOTransaction(receiver.Address, big.NewInt(1))
+	sender.unspent = genesis.(*UTXOSet).unspentOf(sender.Address)
+	toOther, ok2 := sender.newUTXOTransaction(other.Address, big.NewInt(2))
+	if ok == false || ok2 == false || toReceiver.Inputs[0] != toOther.Inputs[0] {
+		t.Fatal("txns do not spend the same output")
+	}
+	finalMemberOf := func(blocks ...[]Transaction) *Elastico {
+		e := &Elastico{ledgerState: genesis, CommitteeConsensusData: make(map[int64]map[string][]string), CommitteeConsensusDataTxns: make(map[int64]map[string][]Transaction)}
+		for committeeid, block := range blocks {
+			digest := txnHexdigest(block)
+			e.CommitteeConsensusData[int64(committeeid)] = map[string][]string{digest: make([]string, quorum.Weak())}
+			e.CommitteeConsensusDataTxns[int64(committeeid)] = map[string][]Transaction{digest: block}
+		}
+		e.verifyAndMergeConsensusData()
+		return e
+	}
+	for _, blocks := range [][][]Transaction{{{toReceiver}, {toOther}}, {{toOther}, {toReceiver}}} {
+		winner := blocks[0][0]
+		for i := 0; i < 3; i++ {
+			e := finalMemberOf(blocks...)
+			if len(e.mergedBlock) != 1 || e.mergedBlock[0].isEqual(winner) == false {
+				t.Fatalf("merged %d txns, the txn of committee 0 not the winner", len(e.mergedBlock))
+			}
+		}
+	}
+}
+
+func TestBlocksKeepTheCanonicalOrder(t *testing.T) {
+	/*
+		the requests and the committee blocks arrive in any order, the blocks and their merkle roots are the same
+	*/
+	savedS := s
+	t.Cleanup(func() { s = savedS })
+	s = 2
+	receiver := newClient()
+	clients := []*Client{receiver}
+	blocks := make([][]Transaction, 4)
+	for committeeid := range blocks {
+		sender := newClient()
+		clients = append(clients, sender)
+		for i := 0; i < 3; i++ {
+			blocks[committeeid] = append(blocks[committeeid], sender.newTransaction(receiver.Address, big.NewInt(int64(1+i))))
+		}
+	}
+	genesis := genesisState(clients)
+
+	// the requests of a committee committed in another order and view
+	txnBlockOf := func(order []int, viewOf func(seqnum int) int) []Transaction {
+		e := &Elastico{committedData: make(map[int]map[int][]Transaction)}
+		for _, i := range order {
+			viewID := viewOf(i)
+			if _, ok := e.committedData[viewID]; ok == false {
+				e.committedData[viewID] = make(map[int][]Transaction)
+			}
+			e.committedData[viewID][i+1] = blocks[i]
+		}
+		e.SendtoFinal(0)
+		return e.txnBlock
+	}
+	inOrder := txnBlockOf([]int{0, 1, 2, 3}, func(int) int { return 0 })
+	shuffled := txnBlockOf([]int{2, 0, 3, 1}, func(seqnum int) int { return seqnum % 2 })
+	if txnHexdigest(inOrder) != txnHexdigest(shuffled) || blockRootHash(inOrder) != blockRootHash(shuffled) {
+		t.Fatal("txn block of the committee depends on the order of the commits")
+	}
+	if txnHexdigest(inOrder[:3]) != txnHexdigest(blocks[0]) {
+		t.Fatal("txn block not in the order of the sequence nums")
+	}
+
+	// the blocks of the committees received in another order
+	mergedOf := func(order []int) []Transaction {
+		e := &Elastico{ledgerState: genesis, CommitteeConsensusData: make(map[int64]map[string][]string), CommitteeConsensusDataTxns: make(map[int64]map[string][]Transaction)}
+		for _, committeeid := range order {
+			digest := txnHexdigest(blocks[committeeid])
+			e.CommitteeConsensusData[int64(committeeid)] = map[string][]string{digest: make([]string, quorum.Weak())}
+			e.CommitteeConsensusDataTxns[int64(committeeid)] = map[string][]Transaction{digest: blocks[committeeid]}
+		}
+		e.verifyAndMergeConsensusData()
+		return e.mergedBlock
+	}
+	merged := mergedOf([]int{0, 1, 2, 3})
+	if len(merged) != 12 || txnHexdigest(merged) != txnHexdigest(inOrder) {
+		t.Fatalf("merged %d txns not in the order of the committee ids", len(merged))
+	}
+	for _, order := range [][]int{{3, 2, 1, 0}, {1, 3, 0, 2}} {
+		if again := mergedOf(order); txnHexdigest(again) != txnHexdigest(merged) || blockRootHash(again) != blockRootHash(merged) {
+			t.Fatalf("merged block depends on the order %v the committee blocks arrived in", order)
+		}
+	}
+}